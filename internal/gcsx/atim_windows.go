@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// getAtime extracts the last-accessed time of fi from the platform's raw
+// file attribute data, since os.FileInfo does not expose atime portably.
+func getAtime(fi os.FileInfo) (time.Time, error) {
+	st, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, fmt.Errorf("unexpected Sys() type %T", fi.Sys())
+	}
+
+	return time.Unix(0, st.LastAccessTime.Nanoseconds()), nil
+}
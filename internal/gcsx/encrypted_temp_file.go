@@ -0,0 +1,599 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jacobsa/fuse/fsutil"
+	"github.com/jacobsa/timeutil"
+)
+
+const (
+	// The size in bytes of each plaintext block. Every block is encrypted
+	// independently, so random-access reads and writes only ever need to
+	// touch the blocks they actually overlap.
+	encryptedBlockSize = 4096
+)
+
+// KeyProvider supplies the AES key used to encrypt and decrypt an
+// EncryptedTempFile's content. Implementations can source the key from a KMS,
+// an environment variable, a mounted secret file, or anywhere else;
+// NewEncryptedTempFile itself doesn't care.
+type KeyProvider interface {
+	// Key returns an AES key of length 16, 24, or 32 bytes, selecting
+	// AES-128, AES-192, or AES-256 respectively.
+	Key(ctx context.Context) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider that always returns the same key that it
+// was constructed with.
+type StaticKeyProvider struct {
+	key []byte
+}
+
+// NewStaticKeyProvider returns a KeyProvider that always returns key.
+func NewStaticKeyProvider(key []byte) StaticKeyProvider {
+	return StaticKeyProvider{key: key}
+}
+
+// Key returns the key supplied to NewStaticKeyProvider.
+func (p StaticKeyProvider) Key(ctx context.Context) ([]byte, error) {
+	return p.key, nil
+}
+
+// EnvKeyProvider is a KeyProvider that reads a base64-encoded key from an
+// environment variable each time it's asked, so that rotating the key only
+// requires updating the environment rather than restarting with a new flag.
+type EnvKeyProvider struct {
+	varName string
+}
+
+// NewEnvKeyProvider returns a KeyProvider that reads its key from the
+// environment variable named varName, base64-encoded (standard encoding).
+func NewEnvKeyProvider(varName string) EnvKeyProvider {
+	return EnvKeyProvider{varName: varName}
+}
+
+// Key reads and decodes the key from the environment.
+func (p EnvKeyProvider) Key(ctx context.Context) ([]byte, error) {
+	encoded := os.Getenv(p.varName)
+	if encoded == "" {
+		return nil, fmt.Errorf("%s is not set", p.varName)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %v", p.varName, err)
+	}
+
+	return key, nil
+}
+
+// NewEncryptedTempFile is like NewTempFile, except content is encrypted at
+// rest. It's split into fixed-size plaintext blocks (encryptedBlockSize
+// bytes, except possibly the last), each sealed independently with AES-GCM
+// under a key obtained from keyProvider, with a fresh random nonce generated
+// for every block sealed and stored on disk alongside its ciphertext. This
+// keeps the OS temp directory free of plaintext object content for the
+// lifetime of the mount, at the cost of re-encrypting one block per byte
+// range touched by a write. The key returned by keyProvider must be 16, 24,
+// or 32 bytes long.
+func NewEncryptedTempFile(
+	ctx context.Context,
+	content io.Reader,
+	dir string,
+	clock timeutil.Clock,
+	keyProvider KeyProvider) (tf TempFile, err error) {
+	key, err := keyProvider.Key(ctx)
+	if err != nil {
+		err = fmt.Errorf("Key: %v", err)
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		err = fmt.Errorf("NewCipher: %v", err)
+		return
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		err = fmt.Errorf("NewGCM: %v", err)
+		return
+	}
+
+	f, err := fsutil.AnonymousFile(dir)
+	if err != nil {
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	ef := &encryptedTempFile{
+		clock: clock,
+		f:     f,
+		aead:  aead,
+	}
+
+	buf := make([]byte, encryptedBlockSize)
+	for {
+		n, readErr := io.ReadFull(content, buf)
+		if n > 0 {
+			if err = ef.appendBlock(buf[:n]); err != nil {
+				return
+			}
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if readErr != nil {
+			err = fmt.Errorf("read content: %v", readErr)
+			return
+		}
+	}
+
+	tf = ef
+
+	return
+}
+
+type encryptedTempFile struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	clock timeutil.Clock
+	aead  cipher.AEAD
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	destroyed bool
+
+	// The backing file: one (nonce, ciphertext) pair per plaintext block,
+	// packed back to back. The nonce is regenerated every time its block is
+	// (re-)sealed, so it's stored alongside the ciphertext rather than
+	// derived from anything, which is what keeps repeated writes to the same
+	// block from ever reusing a (key, nonce) pair.
+	f *os.File
+
+	// The number of blocks currently making up the file, and the plaintext
+	// length of the last one (meaningless if numBlocks == 0). Every block
+	// before the last is always exactly encryptedBlockSize bytes of
+	// plaintext; only the last may be shorter.
+	//
+	// Logical size is therefore (numBlocks-1)*encryptedBlockSize +
+	// lastBlockLen, and on-disk ciphertext size is exactly
+	// numBlocks*(aead.NonceSize()+aead.Overhead()) more than that, since
+	// AES-GCM adds a fixed-size tag per block regardless of its length, and
+	// every block carries its own nonce.
+	numBlocks    int
+	lastBlockLen int64
+
+	// The current offset for Read/Seek.
+	pos int64
+
+	// The byte ranges that have been modified from the initial contents.
+	dirtyRanges rangeSet
+
+	// The time at which a method that modifies our contents was last called,
+	// or nil if never.
+	mtime *time.Time
+
+	// The time of the last read and the last metadata/content change,
+	// respectively, or nil if never set. Always updated under Strict
+	// semantics, since NewEncryptedTempFile has no way to accept a
+	// TimestampPolicy.
+	atime *time.Time
+	ctime *time.Time
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+func (ef *encryptedTempFile) CheckInvariants() {
+	if ef.destroyed {
+		panic("Use of destroyed encryptedTempFile object.")
+	}
+
+	sr, err := ef.Stat()
+	if err != nil {
+		panic(fmt.Sprintf("Stat: %v", err))
+	}
+
+	if !(sr.DirtyThreshold <= sr.Size) {
+		panic(fmt.Sprintf("Mismatch: %d vs. %d", sr.DirtyThreshold, sr.Size))
+	}
+
+	if ef.mtime == nil && sr.DirtyThreshold != sr.Size {
+		panic(fmt.Sprintf("Mismatch: %d vs. %d", sr.DirtyThreshold, sr.Size))
+	}
+}
+
+func (ef *encryptedTempFile) Destroy() {
+	ef.destroyed = true
+
+	ef.f.Close()
+	ef.f = nil
+}
+
+func (ef *encryptedTempFile) Read(p []byte) (int, error) {
+	n, err := ef.ReadAt(p, ef.pos)
+	ef.pos += int64(n)
+
+	return n, err
+}
+
+func (ef *encryptedTempFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		ef.pos = offset
+	case io.SeekCurrent:
+		ef.pos += offset
+	case io.SeekEnd:
+		ef.pos = ef.logicalSize() + offset
+	default:
+		return 0, fmt.Errorf("unknown whence: %d", whence)
+	}
+
+	return ef.pos, nil
+}
+
+func (ef *encryptedTempFile) ReadAt(p []byte, offset int64) (int, error) {
+	ef.bumpAtime()
+
+	size := ef.logicalSize()
+	if offset >= size {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	end := offset + int64(len(p))
+	truncated := end > size
+	if truncated {
+		end = size
+	}
+
+	n := 0
+	for b := int(offset / encryptedBlockSize); int64(b)*encryptedBlockSize < end; b++ {
+		buf, err := ef.readLogicalBlockZeroPadded(b)
+		if err != nil {
+			return n, err
+		}
+
+		blockStart := int64(b) * encryptedBlockSize
+		lo := maxInt64(offset, blockStart) - blockStart
+		hi := minInt64(end, blockStart+encryptedBlockSize) - blockStart
+
+		copy(p[blockStart+lo-offset:], buf[lo:hi])
+		n += int(hi - lo)
+	}
+
+	var err error
+	if truncated {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (ef *encryptedTempFile) Stat() (sr StatResult, err error) {
+	sr.Size = ef.logicalSize()
+	sr.DirtyRanges = ef.dirtyRanges.clone()
+	sr.Mtime = ef.mtime
+	sr.Atime = ef.atime
+	sr.Ctime = ef.ctime
+
+	sr.DirtyThreshold = sr.Size
+	if len(sr.DirtyRanges) > 0 {
+		sr.DirtyThreshold = sr.DirtyRanges[0].Start
+	}
+
+	return
+}
+
+func (ef *encryptedTempFile) ForEachDirtyRange(f func(off, len int64)) {
+	ef.dirtyRanges.forEach(f)
+}
+
+func (ef *encryptedTempFile) WriteAt(p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	end := offset + int64(len(p))
+	oldSize := ef.logicalSize()
+
+	newSize := end
+	if oldSize > newSize {
+		newSize = oldSize
+	}
+
+	rewriteFrom := int(offset / encryptedBlockSize)
+	switch {
+	case ef.numBlocks == 0:
+		// Nothing exists yet; any blocks before the write's start block must
+		// be created as zero blocks too.
+		rewriteFrom = 0
+	case ef.numBlocks-1 < rewriteFrom:
+		// The old last block sits in the gap before this write; it must be
+		// padded out to full length now that it's no longer the last block.
+		rewriteFrom = ef.numBlocks - 1
+	}
+
+	// Only the blocks through the end of this write need touching: if the
+	// write doesn't grow the file, anything past it is untouched and must be
+	// left alone rather than needlessly re-encrypted.
+	rewriteTo := numBlocksForSize(end)
+
+	if err := ef.rewriteBlocks(rewriteFrom, rewriteTo, newSize, offset, p); err != nil {
+		return 0, err
+	}
+
+	// A write past the end leaves a zero-filled gap that never existed in the
+	// original content, so it is marked dirty too, like a grown tail.
+	if offset > oldSize {
+		ef.dirtyRanges.insert(oldSize, offset)
+	}
+	ef.dirtyRanges.insert(offset, end)
+
+	newMtime := ef.clock.Now()
+	ef.mtime = &newMtime
+	ef.bumpCtime()
+
+	return len(p), nil
+}
+
+func (ef *encryptedTempFile) Truncate(n int64) error {
+	oldSize := ef.logicalSize()
+
+	var rewriteFrom int
+	if n >= oldSize {
+		// Growing (or a no-op): start from the old last block, since it may
+		// need padding out, through to whatever new blocks are required.
+		rewriteFrom = ef.numBlocks - 1
+	} else {
+		// Shrinking: only the new last block needs to be re-encrypted, at
+		// its shorter length; everything after it is simply dropped.
+		rewriteFrom = numBlocksForSize(n) - 1
+	}
+
+	if rewriteFrom < 0 {
+		rewriteFrom = 0
+	}
+
+	if err := ef.rewriteBlocks(rewriteFrom, numBlocksForSize(n), n, 0, nil); err != nil {
+		return err
+	}
+
+	// Growing fabricates a zero-filled tail that never existed in the
+	// original content, so it must be marked dirty too; truncate alone only
+	// clips or drops existing ranges, it never adds one.
+	ef.dirtyRanges.truncate(n)
+	if n > oldSize {
+		ef.dirtyRanges.insert(oldSize, n)
+	}
+
+	newMtime := ef.clock.Now()
+	ef.mtime = &newMtime
+	ef.bumpCtime()
+
+	return nil
+}
+
+func (ef *encryptedTempFile) SetMtime(mtime time.Time) {
+	ef.mtime = &mtime
+	ef.bumpCtime()
+}
+
+func (ef *encryptedTempFile) SetAtime(atime time.Time) {
+	ef.atime = &atime
+}
+
+func (ef *encryptedTempFile) SetCtime(ctime time.Time) {
+	ef.ctime = &ctime
+}
+
+func (ef *encryptedTempFile) SetMode() {
+	ef.bumpCtime()
+}
+
+func (ef *encryptedTempFile) SetOwner() {
+	ef.bumpCtime()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// bumpAtime unconditionally sets atime to the current time, matching the
+// Strict TimestampPolicy (the only one available to encryptedTempFile, which
+// has no way to accept a TimestampPolicy of its own).
+func (ef *encryptedTempFile) bumpAtime() {
+	now := ef.clock.Now()
+	ef.atime = &now
+}
+
+// bumpCtime unconditionally sets ctime to the current time.
+func (ef *encryptedTempFile) bumpCtime() {
+	now := ef.clock.Now()
+	ef.ctime = &now
+}
+
+// numBlocksForSize returns the number of blocks needed to hold size bytes of
+// plaintext.
+func numBlocksForSize(size int64) int {
+	if size <= 0 {
+		return 0
+	}
+
+	return int((size + encryptedBlockSize - 1) / encryptedBlockSize)
+}
+
+// logicalSize returns the current plaintext size of the file.
+func (ef *encryptedTempFile) logicalSize() int64 {
+	if ef.numBlocks == 0 {
+		return 0
+	}
+
+	return int64(ef.numBlocks-1)*encryptedBlockSize + ef.lastBlockLen
+}
+
+// blockStride returns the number of bytes a full-length block occupies on
+// disk, nonce included.
+func (ef *encryptedTempFile) blockStride() int64 {
+	return int64(ef.aead.NonceSize()) + int64(encryptedBlockSize) + int64(ef.aead.Overhead())
+}
+
+// blockOffset returns the byte offset within the backing file at which
+// block b's (nonce, ciphertext) pair begins.
+func (ef *encryptedTempFile) blockOffset(b int) int64 {
+	return int64(b) * ef.blockStride()
+}
+
+// readLogicalBlockZeroPadded returns an encryptedBlockSize buffer holding
+// block b's plaintext, zero-padded past its logical length (or entirely
+// zero if b doesn't exist yet, i.e. lies in a gap past the current EOF).
+func (ef *encryptedTempFile) readLogicalBlockZeroPadded(b int) ([]byte, error) {
+	buf := make([]byte, encryptedBlockSize)
+
+	if b >= ef.numBlocks {
+		return buf, nil
+	}
+
+	plainLen := int64(encryptedBlockSize)
+	if b == ef.numBlocks-1 {
+		plainLen = ef.lastBlockLen
+	}
+
+	nonceSize := ef.aead.NonceSize()
+	sealed := make([]byte, int64(nonceSize)+plainLen+int64(ef.aead.Overhead()))
+	if _, err := ef.f.ReadAt(sealed, ef.blockOffset(b)); err != nil {
+		return nil, fmt.Errorf("ReadAt: %v", err)
+	}
+
+	nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
+	plaintext, err := ef.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %v", err)
+	}
+
+	copy(buf, plaintext)
+
+	return buf, nil
+}
+
+// writeBlock seals plaintext (which must be at most encryptedBlockSize
+// bytes) under a freshly generated nonce and writes the (nonce, ciphertext)
+// pair as block b, growing the backing file if necessary. A fresh nonce is
+// generated on every call, even for a block that's been written before, so
+// that re-encrypting a block after an edit never reuses a (key, nonce) pair.
+func (ef *encryptedTempFile) writeBlock(b int, plaintext []byte) error {
+	nonce := make([]byte, ef.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("rand.Read: %v", err)
+	}
+
+	sealed := ef.aead.Seal(nonce, nonce, plaintext, nil)
+
+	if _, err := ef.f.WriteAt(sealed, ef.blockOffset(b)); err != nil {
+		return fmt.Errorf("WriteAt: %v", err)
+	}
+
+	return nil
+}
+
+// appendBlock writes plaintext as a brand new block at the current end of
+// the file, used while populating initial content in NewEncryptedTempFile.
+func (ef *encryptedTempFile) appendBlock(plaintext []byte) error {
+	b := ef.numBlocks
+	if err := ef.writeBlock(b, plaintext); err != nil {
+		return err
+	}
+
+	ef.numBlocks++
+	ef.lastBlockLen = int64(len(plaintext))
+
+	return nil
+}
+
+// rewriteBlocks re-encrypts blocks [from, to) so that the file's logical
+// size becomes newSize (which determines the final block count and the
+// plaintext length of the last block). If p is non-nil, it is overlaid into
+// the result at offset (used by WriteAt); Truncate passes a nil p. Blocks
+// before from, and at or beyond to, are left untouched; the backing file is
+// truncated at the end to drop anything beyond the new last block.
+func (ef *encryptedTempFile) rewriteBlocks(from, to int, newSize, offset int64, p []byte) error {
+	newNumBlocks := numBlocksForSize(newSize)
+
+	newLastBlockLen := int64(0)
+	if newNumBlocks > 0 {
+		newLastBlockLen = newSize - int64(newNumBlocks-1)*encryptedBlockSize
+	}
+
+	pEnd := offset + int64(len(p))
+
+	for b := from; b < to; b++ {
+		buf, err := ef.readLogicalBlockZeroPadded(b)
+		if err != nil {
+			return err
+		}
+
+		blockStart := int64(b) * encryptedBlockSize
+		lo := maxInt64(offset, blockStart) - blockStart
+		hi := minInt64(pEnd, blockStart+encryptedBlockSize) - blockStart
+		if lo < hi {
+			copy(buf[lo:hi], p[blockStart+lo-offset:blockStart+hi-offset])
+		}
+
+		storeLen := int64(encryptedBlockSize)
+		if b == newNumBlocks-1 {
+			storeLen = newLastBlockLen
+		}
+
+		if err := ef.writeBlock(b, buf[:storeLen]); err != nil {
+			return err
+		}
+	}
+
+	var ciphertextSize int64
+	if newNumBlocks > 0 {
+		ciphertextSize = int64(newNumBlocks-1)*ef.blockStride() +
+			int64(ef.aead.NonceSize()) + newLastBlockLen + int64(ef.aead.Overhead())
+	}
+
+	if err := ef.f.Truncate(ciphertextSize); err != nil {
+		return fmt.Errorf("Truncate: %v", err)
+	}
+
+	ef.numBlocks = newNumBlocks
+	ef.lastBlockLen = newLastBlockLen
+
+	return nil
+}
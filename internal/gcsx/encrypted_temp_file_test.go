@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/timeutil"
+)
+
+func testKeyProvider() KeyProvider {
+	return NewStaticKeyProvider(bytes.Repeat([]byte{0x42}, 32))
+}
+
+func newTestEncryptedTempFile(t *testing.T, content string) TempFile {
+	t.Helper()
+
+	tf, err := NewEncryptedTempFile(context.Background(), strings.NewReader(content), "", timeutil.RealClock(), testKeyProvider())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+func TestEncryptedTempFileRoundTrip(t *testing.T) {
+	const content = "the quick brown fox jumps over the lazy dog"
+
+	tf := newTestEncryptedTempFile(t, content)
+	defer tf.Destroy()
+
+	buf := make([]byte, len(content))
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != content {
+		t.Errorf("got %q, want %q", buf, content)
+	}
+}
+
+func TestEncryptedTempFileRoundTripAcrossMultipleBlocks(t *testing.T) {
+	content := strings.Repeat("0123456789", encryptedBlockSize/5)
+
+	tf := newTestEncryptedTempFile(t, content)
+	defer tf.Destroy()
+
+	buf := make([]byte, len(content))
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != content {
+		t.Error("multi-block round trip did not return the original content")
+	}
+}
+
+// Repeatedly overwriting the same block must each time produce a correctly
+// decryptable result, with the block re-sealed under a fresh nonce on every
+// write. This checks the round trip only; it does not inspect the nonces.
+func TestEncryptedTempFileRepeatedWritesToSameBlock(t *testing.T) {
+	tf := newTestEncryptedTempFile(t, strings.Repeat("\x00", encryptedBlockSize))
+	defer tf.Destroy()
+
+	for i := 0; i < 5; i++ {
+		plaintext := bytes.Repeat([]byte{byte('A' + i)}, encryptedBlockSize)
+		if _, err := tf.WriteAt(plaintext, 0); err != nil {
+			t.Fatalf("write #%d: %v", i, err)
+		}
+
+		buf := make([]byte, encryptedBlockSize)
+		if _, err := tf.ReadAt(buf, 0); err != nil {
+			t.Fatalf("read back #%d: %v", i, err)
+		}
+		if !bytes.Equal(buf, plaintext) {
+			t.Fatalf("write #%d: read back %q..., want all %q", i, buf[:8], plaintext[:8])
+		}
+	}
+}
+
+func TestEncryptedTempFileWriteAtPartialBlockPreservesRestOfBlock(t *testing.T) {
+	content := strings.Repeat("x", encryptedBlockSize)
+
+	tf := newTestEncryptedTempFile(t, content)
+	defer tf.Destroy()
+
+	if _, err := tf.WriteAt([]byte("YZ"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, encryptedBlockSize)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte(content)
+	want[10], want[11] = 'Y', 'Z'
+	if !bytes.Equal(buf, want) {
+		t.Errorf("got %q, want %q", buf, want)
+	}
+}
+
+func TestEncryptedTempFileTruncateGrowReadsZeroes(t *testing.T) {
+	tf := newTestEncryptedTempFile(t, "hello")
+	defer tf.Destroy()
+
+	if err := tf.Truncate(10); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 10)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello\x00\x00\x00\x00\x00" {
+		t.Errorf("got %q", buf)
+	}
+}
+
+func TestEncryptedTempFileTruncateShrink(t *testing.T) {
+	tf := newTestEncryptedTempFile(t, "hello world")
+	defer tf.Destroy()
+
+	if err := tf.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Size != 5 {
+		t.Fatalf("Size = %d, want 5", sr.Size)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q, want %q", buf, "hello")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+// Range represents a half-open byte range [Start, End) within a file.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// Len returns the number of bytes spanned by the range.
+func (r Range) Len() int64 {
+	return r.End - r.Start
+}
+
+// rangeSet is an ordered set of disjoint, non-adjacent half-open byte
+// ranges. Ranges are kept sorted by Start and are merged on insert, so two
+// ranges that overlap or abut are coalesced into a single entry.
+//
+// Not safe for concurrent access.
+type rangeSet struct {
+	// INVARIANT: ranges is sorted by Start.
+	// INVARIANT: for all i, ranges[i].Start < ranges[i].End.
+	// INVARIANT: for all i, ranges[i].End < ranges[i+1].Start.
+	ranges []Range
+}
+
+// insert adds [start, end) to the set, merging it with any ranges that it
+// overlaps or touches. Does nothing if end <= start.
+func (s *rangeSet) insert(start, end int64) {
+	if end <= start {
+		return
+	}
+
+	merged := Range{Start: start, End: end}
+	inserted := false
+	out := make([]Range, 0, len(s.ranges)+1)
+
+	for _, r := range s.ranges {
+		switch {
+		case r.End < merged.Start:
+			// r is entirely before the new range.
+			out = append(out, r)
+
+		case r.Start > merged.End:
+			// r is entirely after the new range; flush the new range first.
+			if !inserted {
+				out = append(out, merged)
+				inserted = true
+			}
+
+			out = append(out, r)
+
+		default:
+			// r overlaps or touches the new range; fold it in.
+			if r.Start < merged.Start {
+				merged.Start = r.Start
+			}
+
+			if r.End > merged.End {
+				merged.End = r.End
+			}
+		}
+	}
+
+	if !inserted {
+		out = append(out, merged)
+	}
+
+	s.ranges = out
+}
+
+// truncate drops any portion of the set at or beyond n, clamping ranges
+// that straddle n and discarding those that start at or after it.
+func (s *rangeSet) truncate(n int64) {
+	out := s.ranges[:0]
+	for _, r := range s.ranges {
+		if r.Start >= n {
+			continue
+		}
+
+		if r.End > n {
+			r.End = n
+		}
+
+		out = append(out, r)
+	}
+
+	s.ranges = out
+}
+
+// clone returns a copy of the set's ranges, safe for the caller to retain.
+func (s *rangeSet) clone() []Range {
+	if len(s.ranges) == 0 {
+		return nil
+	}
+
+	out := make([]Range, len(s.ranges))
+	copy(out, s.ranges)
+
+	return out
+}
+
+// forEach invokes f once per range in the set, in ascending order of Start.
+func (s *rangeSet) forEach(f func(off, len int64)) {
+	for _, r := range s.ranges {
+		f(r.Start, r.Len())
+	}
+}
+
+// gaps returns the portions of [start, end) not covered by the set, in
+// ascending order. Does nothing if end <= start.
+func (s *rangeSet) gaps(start, end int64) []Range {
+	if end <= start {
+		return nil
+	}
+
+	var out []Range
+	cur := start
+
+	for _, r := range s.ranges {
+		if r.End <= cur {
+			continue
+		}
+
+		if r.Start >= end {
+			break
+		}
+
+		if r.Start > cur {
+			out = append(out, Range{Start: cur, End: minInt64(r.Start, end)})
+		}
+
+		if r.End > cur {
+			cur = r.End
+		}
+
+		if cur >= end {
+			break
+		}
+	}
+
+	if cur < end {
+		out = append(out, Range{Start: cur, End: end})
+	}
+
+	return out
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
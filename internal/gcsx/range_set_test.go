@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func collect(s *rangeSet) []Range {
+	var out []Range
+	s.forEach(func(off, ln int64) {
+		out = append(out, Range{Start: off, End: off + ln})
+	})
+	return out
+}
+
+func TestRangeSetInsertMerges(t *testing.T) {
+	cases := []struct {
+		name   string
+		insert [][2]int64
+		want   []Range
+	}{
+		{
+			name:   "disjoint",
+			insert: [][2]int64{{0, 5}, {10, 15}},
+			want:   []Range{{0, 5}, {10, 15}},
+		},
+		{
+			name:   "overlapping",
+			insert: [][2]int64{{0, 10}, {5, 15}},
+			want:   []Range{{0, 15}},
+		},
+		{
+			name:   "touching",
+			insert: [][2]int64{{0, 5}, {5, 10}},
+			want:   []Range{{0, 10}},
+		},
+		{
+			name:   "fills gap between two ranges",
+			insert: [][2]int64{{0, 5}, {10, 15}, {5, 10}},
+			want:   []Range{{0, 15}},
+		},
+		{
+			name:   "empty range is a no-op",
+			insert: [][2]int64{{5, 5}, {10, 5}},
+			want:   nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var s rangeSet
+			for _, r := range c.insert {
+				s.insert(r[0], r[1])
+			}
+
+			got := collect(&s)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("insert(%v) = %v, want %v", c.insert, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRangeSetTruncate(t *testing.T) {
+	cases := []struct {
+		name string
+		n    int64
+		want []Range
+	}{
+		{name: "past everything", n: 100, want: []Range{{0, 5}, {10, 20}}},
+		{name: "drops a range entirely", n: 10, want: []Range{{0, 5}}},
+		{name: "clamps a straddling range", n: 15, want: []Range{{0, 5}, {10, 15}}},
+		{name: "drops everything", n: 0, want: nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var s rangeSet
+			s.insert(0, 5)
+			s.insert(10, 20)
+
+			s.truncate(c.n)
+
+			got := collect(&s)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("truncate(%d) = %v, want %v", c.n, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRangeSetGaps(t *testing.T) {
+	var s rangeSet
+	s.insert(5, 10)
+	s.insert(20, 25)
+
+	cases := []struct {
+		name       string
+		start, end int64
+		want       []Range
+	}{
+		{name: "entirely within a gap", start: 0, end: 5, want: []Range{{0, 5}}},
+		{name: "spans both ranges and the gap between them", start: 0, end: 30,
+			want: []Range{{0, 5}, {10, 20}, {25, 30}}},
+		{name: "entirely within a populated range", start: 6, end: 9, want: nil},
+		{name: "empty query", start: 5, end: 5, want: nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := s.gaps(c.start, c.end)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("gaps(%d, %d) = %v, want %v", c.start, c.end, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jacobsa/fuse/fsutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// NewSparseTempFile creates a temp file of the given size without fetching
+// any of its content up front. Instead, fetch is invoked on demand for
+// whatever byte ranges a Read or ReadAt caller actually asks for, the first
+// time each range is touched; dir and clock are as in NewTempFile.
+//
+// This avoids the whole-object download NewTempFile requires, which matters
+// for multi-GB objects when only a small slice of them will ever be read
+// (e.g. a Parquet footer, or a seek-heavy media file).
+func NewSparseTempFile(
+	size int64,
+	fetch func(off, len int64) (io.ReadCloser, error),
+	dir string,
+	clock timeutil.Clock) (tf TempFile, err error) {
+	f, err := fsutil.AnonymousFile(dir)
+	if err != nil {
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	// Truncating up front to the object's full size gives us a sparse file on
+	// any filesystem that supports holes, without an explicit fallocate
+	// call: the gap between 0 and size is never actually written to disk
+	// until a read or write touches it.
+	if err = f.Truncate(size); err != nil {
+		err = fmt.Errorf("Truncate: %v", err)
+		return
+	}
+
+	tf = &sparseTempFile{
+		tempFile: &tempFile{clock: clock, f: f},
+		fetch:    fetch,
+	}
+
+	return
+}
+
+// sparseTempFile is a TempFile whose initial content is populated lazily:
+// any byte range that hasn't yet been fetched or written is a hole, which
+// Read/ReadAt fill in on demand by calling fetch before delegating to the
+// embedded tempFile for the actual I/O.
+//
+// Not safe for concurrent access.
+type sparseTempFile struct {
+	*tempFile
+
+	fetch func(off, len int64) (io.ReadCloser, error)
+
+	// The byte ranges of [0, Stat().Size) that already hold real content,
+	// whether from a prior fetch or from a WriteAt/Truncate.
+	//
+	// INVARIANT: dirty ⊆ populated, where dirty is tf.dirtyRanges.
+	populated rangeSet
+}
+
+func (stf *sparseTempFile) Read(p []byte) (int, error) {
+	pos, err := stf.tempFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := stf.ensurePopulated(pos, int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	return stf.tempFile.Read(p)
+}
+
+func (stf *sparseTempFile) ReadAt(p []byte, offset int64) (int, error) {
+	if err := stf.ensurePopulated(offset, int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	return stf.tempFile.ReadAt(p, offset)
+}
+
+func (stf *sparseTempFile) WriteAt(p []byte, offset int64) (int, error) {
+	oldSize, err := stf.currentSize()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := stf.tempFile.WriteAt(p, offset)
+
+	// A write past the end leaves a zero-filled gap that tempFile marks dirty;
+	// like a grown tail, there's nothing to fetch for it.
+	if len(p) > 0 && offset > oldSize {
+		stf.populated.insert(oldSize, offset)
+	}
+
+	if n > 0 {
+		stf.populated.insert(offset, offset+int64(n))
+	}
+
+	return n, err
+}
+
+func (stf *sparseTempFile) Truncate(n int64) error {
+	oldSize, err := stf.currentSize()
+	if err != nil {
+		return err
+	}
+
+	if err := stf.tempFile.Truncate(n); err != nil {
+		return err
+	}
+
+	if n > oldSize {
+		// The newly-exposed tail is implicitly zero, same as a plain
+		// Truncate; there's nothing to fetch for it.
+		stf.populated.insert(oldSize, n)
+	} else {
+		stf.populated.truncate(n)
+	}
+
+	return nil
+}
+
+func (stf *sparseTempFile) Stat() (sr StatResult, err error) {
+	sr, err = stf.tempFile.Stat()
+	if err != nil {
+		return
+	}
+
+	stf.populated.forEach(func(off, ln int64) {
+		sr.PopulatedBytes += ln
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// currentSize returns the file's current logical size. Unlike tempFile.Stat,
+// this leaves the underlying file's seek position untouched, so Read still
+// reads from where the caller left off.
+func (stf *sparseTempFile) currentSize() (int64, error) {
+	fi, err := stf.tempFile.f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("Stat: %v", err)
+	}
+
+	return fi.Size(), nil
+}
+
+// ensurePopulated fetches and materializes any part of [offset, offset+len)
+// that isn't already populated, clamped to the file's current size.
+func (stf *sparseTempFile) ensurePopulated(offset, length int64) error {
+	size, err := stf.currentSize()
+	if err != nil {
+		return err
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	end := offset + length
+	if end > size {
+		end = size
+	}
+
+	for _, gap := range stf.populated.gaps(offset, end) {
+		if err := stf.fetchInto(gap.Start, gap.Len()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchInto downloads [off, off+length) via stf.fetch, writes it into the
+// backing file, and marks it populated. The write bypasses tempFile.WriteAt
+// so that materializing original content is never mistaken for a dirty edit.
+func (stf *sparseTempFile) fetchInto(off, length int64) error {
+	rc, err := stf.fetch(off, length)
+	if err != nil {
+		return fmt.Errorf("fetch: %v", err)
+	}
+	defer rc.Close()
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		return fmt.Errorf("read fetched content: %v", err)
+	}
+
+	if _, err := stf.tempFile.f.WriteAt(buf, off); err != nil {
+		return fmt.Errorf("WriteAt: %v", err)
+	}
+
+	stf.populated.insert(off, off+length)
+
+	return nil
+}
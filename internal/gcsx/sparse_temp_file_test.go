@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// recordingFetch returns a fetch callback for NewSparseTempFile that serves
+// slices of content and records the (off, len) of every call it receives.
+func recordingFetch(content string, calls *[][2]int64) func(off, len int64) (io.ReadCloser, error) {
+	return func(off, length int64) (io.ReadCloser, error) {
+		*calls = append(*calls, [2]int64{off, length})
+		return io.NopCloser(strings.NewReader(content[off : off+length])), nil
+	}
+}
+
+func TestSparseTempFileFetchesOnlyOnFirstTouch(t *testing.T) {
+	const content = "0123456789ABCDEF"
+	var calls [][2]int64
+
+	tf, err := NewSparseTempFile(int64(len(content)), recordingFetch(content, &calls), "", timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	buf := make([]byte, 4)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "0123" {
+		t.Errorf("got %q, want %q", buf, "0123")
+	}
+	if len(calls) != 1 || calls[0] != [2]int64{0, 4} {
+		t.Errorf("calls = %v, want a single fetch of [0, 4)", calls)
+	}
+
+	// Reading the same range again must not re-fetch it.
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 {
+		t.Errorf("calls = %v, want still just the one fetch (re-read of a populated range)", calls)
+	}
+
+	// A read overlapping both populated and unpopulated bytes should fetch
+	// only the gap.
+	if _, err := tf.ReadAt(buf, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[1] != [2]int64{4, 2} {
+		t.Errorf("calls = %v, want a second fetch of just the gap [4, 6)", calls)
+	}
+}
+
+func TestSparseTempFileWriteAtAvoidsFetch(t *testing.T) {
+	const content = "0123456789"
+	var calls [][2]int64
+
+	tf, err := NewSparseTempFile(int64(len(content)), recordingFetch(content, &calls), "", timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	if _, err := tf.WriteAt([]byte("XY"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("WriteAt triggered fetch calls %v, want none", calls)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "XY23" {
+		t.Errorf("got %q, want %q", buf, "XY23")
+	}
+	// Only the still-unpopulated [2, 4) should have been fetched.
+	if len(calls) != 1 || calls[0] != [2]int64{2, 2} {
+		t.Errorf("calls = %v, want a single fetch of the still-unpopulated [2, 4)", calls)
+	}
+}
+
+func TestSparseTempFileStatReportsPopulatedBytes(t *testing.T) {
+	const content = "0123456789"
+	var calls [][2]int64
+
+	tf, err := NewSparseTempFile(int64(len(content)), recordingFetch(content, &calls), "", timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	sr, err := tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.PopulatedBytes != 0 {
+		t.Errorf("PopulatedBytes = %d before any read, want 0", sr.PopulatedBytes)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err = tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.PopulatedBytes != 4 {
+		t.Errorf("PopulatedBytes = %d after reading [0, 4), want 4", sr.PopulatedBytes)
+	}
+}
+
+func TestSparseTempFileTruncateGrowSkipsFetch(t *testing.T) {
+	const content = "01234567890123456789"
+	var calls [][2]int64
+
+	tf, err := NewSparseTempFile(10, recordingFetch(content, &calls), "", timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	if err := tf.Truncate(20); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 20)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The grown tail [10, 20) is implicitly zero, same as a plain Truncate;
+	// it must never be fetched for.
+	if len(calls) != 1 || calls[0] != [2]int64{0, 10} {
+		t.Errorf("calls = %v, want a single fetch of just the original [0, 10)", calls)
+	}
+	if string(buf[10:]) != "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("grown tail = %q, want all zero bytes", buf[10:])
+	}
+}
@@ -24,7 +24,7 @@ import (
 	"github.com/jacobsa/timeutil"
 )
 
-// TempFile is a temporary file that keeps track of the lowest offset at which
+// TempFile is a temporary file that keeps track of the byte ranges at which
 // it has been modified.
 //
 // Not safe for concurrent access.
@@ -42,15 +42,82 @@ type TempFile interface {
 	// the seek position.
 	Stat() (sr StatResult, err error)
 
+	// Invoke f once for each dirty byte range currently tracked, in ascending
+	// order of offset, passing the offset and length of each range.
+	ForEachDirtyRange(f func(off, len int64))
+
 	// Explicitly set the mtime that will return in stat results. This will stick
 	// until another method that modifies the file is called.
 	SetMtime(mtime time.Time)
 
+	// Explicitly set the atime/ctime that will return in stat results. Like
+	// SetMtime, these stick until another method updates them.
+	SetAtime(atime time.Time)
+	SetCtime(ctime time.Time)
+
+	// Note that the mode bits or owning uid/gid visible through some other
+	// layer (e.g. the inode wrapping this TempFile) have changed, bumping
+	// Ctime accordingly. TempFile does not store mode or ownership itself.
+	SetMode()
+	SetOwner()
+
 	// Throw away the resources used by the temporary file. The object must not
 	// be used again.
 	Destroy()
 }
 
+// TimestampPolicy controls when Read/ReadAt update a TempFile's Atime,
+// mirroring the strictatime/relatime/noatime Linux mount options.
+type TimestampPolicy int
+
+const (
+	// Strict updates Atime on every Read/ReadAt call.
+	Strict TimestampPolicy = iota
+
+	// Relatime updates Atime only if the existing Atime predates Mtime or
+	// Ctime, or is more than a day old, matching Linux's relatime default.
+	Relatime
+
+	// Noatime never updates Atime after creation.
+	Noatime
+)
+
+// relatimeInterval is the "more than a day old" threshold used by Relatime,
+// matching the Linux kernel's relatime behavior.
+const relatimeInterval = 24 * time.Hour
+
+// shouldBumpAtime reports whether, under policy, an access at time now
+// should update Atime given the previous atime/mtime/ctime (any of which may
+// be nil, meaning "never set").
+func shouldBumpAtime(policy TimestampPolicy, now time.Time, atime, mtime, ctime *time.Time) bool {
+	switch policy {
+	case Noatime:
+		return false
+
+	case Relatime:
+		if atime == nil {
+			return true
+		}
+
+		if now.Sub(*atime) > relatimeInterval {
+			return true
+		}
+
+		if mtime != nil && atime.Before(*mtime) {
+			return true
+		}
+
+		if ctime != nil && atime.Before(*ctime) {
+			return true
+		}
+
+		return false
+
+	default: // Strict
+		return true
+	}
+}
+
 // StatResult stores the result of a stat operation.
 type StatResult struct {
 	// The current size in bytes of the content.
@@ -58,9 +125,24 @@ type StatResult struct {
 
 	// The largest value T such that we are sure that the range of bytes [0, T)
 	// is unmodified from the original content with which the temp file was
-	// created.
+	// created. Equivalent to the Start of the first entry of DirtyRanges, or
+	// Size if there are none.
 	DirtyThreshold int64
 
+	// The byte ranges that have been modified from the original content with
+	// which the temp file was created, in ascending order of Start and with no
+	// two ranges overlapping or touching. Uploaders can use this to re-transmit
+	// only the bytes that actually changed instead of everything from
+	// DirtyThreshold to Size.
+	DirtyRanges []Range
+
+	// The number of bytes of Size that are currently backed by real content
+	// in the file rather than an unfetched gap. Only meaningful for temp
+	// files created with NewSparseTempFile; zero otherwise, since every
+	// other TempFile implementation keeps its entire content resident from
+	// the start.
+	PopulatedBytes int64
+
 	// The mtime of the temp file is updated according to the temp file's clock
 	// with each call to a method that modified its content, and is also updated
 	// when the user explicitly calls SetMtime.
@@ -68,15 +150,25 @@ type StatResult struct {
 	// If neither of those things has ever happened, it is nil. This implies that
 	// DirtyThreshold == Size.
 	Mtime *time.Time
+
+	// The time of the temp file's last read, subject to its TimestampPolicy;
+	// nil if never set.
+	Atime *time.Time
+
+	// The time of the temp file's last metadata or content change (Truncate,
+	// WriteAt, SetMtime, SetMode, SetOwner); nil if never set.
+	Ctime *time.Time
 }
 
 // NewTempFile creates a temp file whose initial contents are given by the
 // supplied reader. dir is a directory on whose file system the inode will live,
-// or the system default temporary location if empty.
+// or the system default temporary location if empty. policy governs when
+// Read/ReadAt update the atime reported in stat results.
 func NewTempFile(
 	content io.Reader,
 	dir string,
-	clock timeutil.Clock) (tf TempFile, err error) {
+	clock timeutil.Clock,
+	policy TimestampPolicy) (tf TempFile, err error) {
 	// Create an anonymous file to wrap. When we close it, its resources will be
 	// magically cleaned up.
 	f, err := fsutil.AnonymousFile(dir)
@@ -86,16 +178,16 @@ func NewTempFile(
 	}
 
 	// Copy into the file.
-	size, err := io.Copy(f, content)
+	_, err = io.Copy(f, content)
 	if err != nil {
 		err = fmt.Errorf("copy: %v", err)
 		return
 	}
 
 	tf = &tempFile{
-		clock:          clock,
-		f:              f,
-		dirtyThreshold: size,
+		clock:           clock,
+		f:               f,
+		timestampPolicy: policy,
 	}
 
 	return
@@ -117,16 +209,25 @@ type tempFile struct {
 	// A file containing our current contents.
 	f *os.File
 
-	// The lowest byte index that has been modified from the initial contents.
+	// The byte ranges that have been modified from the initial contents.
 	//
 	// INVARIANT: Stat().DirtyThreshold <= Stat().Size
-	dirtyThreshold int64
+	dirtyRanges rangeSet
 
 	// The time at which a method that modifies our contents was last called, or
 	// nil if never.
 	//
 	// INVARIANT: mtime == nil => Stat().DirtyThreshold == Stat().Size
 	mtime *time.Time
+
+	// The time of the last read and the last metadata/content change,
+	// respectively, or nil if never set. atime's updates are governed by
+	// timestampPolicy.
+	atime *time.Time
+	ctime *time.Time
+
+	// How Read/ReadAt should maintain atime.
+	timestampPolicy TimestampPolicy
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -176,6 +277,7 @@ func (tf *tempFile) Destroy() {
 }
 
 func (tf *tempFile) Read(p []byte) (int, error) {
+	tf.bumpAtime()
 	return tf.f.Read(p)
 }
 
@@ -184,12 +286,15 @@ func (tf *tempFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (tf *tempFile) ReadAt(p []byte, offset int64) (int, error) {
+	tf.bumpAtime()
 	return tf.f.ReadAt(p, offset)
 }
 
 func (tf *tempFile) Stat() (sr StatResult, err error) {
-	sr.DirtyThreshold = tf.dirtyThreshold
+	sr.DirtyRanges = tf.dirtyRanges.clone()
 	sr.Mtime = tf.mtime
+	sr.Atime = tf.atime
+	sr.Ctime = tf.ctime
 
 	// Get the size from the file.
 	sr.Size, err = tf.f.Seek(0, 2)
@@ -198,26 +303,61 @@ func (tf *tempFile) Stat() (sr StatResult, err error) {
 		return
 	}
 
+	// The dirty threshold is the start of the first dirty range, or the size
+	// if nothing is dirty.
+	sr.DirtyThreshold = sr.Size
+	if len(sr.DirtyRanges) > 0 {
+		sr.DirtyThreshold = sr.DirtyRanges[0].Start
+	}
+
 	return
 }
 
+func (tf *tempFile) ForEachDirtyRange(f func(off, len int64)) {
+	tf.dirtyRanges.forEach(f)
+}
+
 func (tf *tempFile) WriteAt(p []byte, offset int64) (int, error) {
-	// Update our state regarding being dirty.
-	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, offset)
+	fi, err := tf.f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("Stat: %v", err)
+	}
 
-	newMtime := tf.clock.Now()
-	tf.mtime = &newMtime
+	// Update our state regarding being dirty. Writing past the end leaves a
+	// zero-filled gap that never existed in the original content, so it is
+	// marked dirty too, just like the grown tail of a Truncate.
+	if len(p) > 0 && offset > fi.Size() {
+		tf.dirtyRanges.insert(fi.Size(), offset)
+	}
+	tf.dirtyRanges.insert(offset, offset+int64(len(p)))
+
+	now := tf.clock.Now()
+	tf.mtime = &now
+	tf.ctime = &now
 
 	// Call through.
 	return tf.f.WriteAt(p, offset)
 }
 
 func (tf *tempFile) Truncate(n int64) error {
-	// Update our state regarding being dirty.
-	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, n)
+	fi, err := tf.f.Stat()
+	if err != nil {
+		return fmt.Errorf("Stat: %v", err)
+	}
+	oldSize := fi.Size()
+
+	// Update our state regarding being dirty. Growing the file fabricates a
+	// zero-filled tail that never existed in the original content, so it must
+	// be marked dirty too; truncate alone only clips or drops existing
+	// ranges, it never adds one.
+	tf.dirtyRanges.truncate(n)
+	if n > oldSize {
+		tf.dirtyRanges.insert(oldSize, n)
+	}
 
-	newMtime := tf.clock.Now()
-	tf.mtime = &newMtime
+	now := tf.clock.Now()
+	tf.mtime = &now
+	tf.ctime = &now
 
 	// Call through.
 	return tf.f.Truncate(n)
@@ -225,16 +365,40 @@ func (tf *tempFile) Truncate(n int64) error {
 
 func (tf *tempFile) SetMtime(mtime time.Time) {
 	tf.mtime = &mtime
+	tf.bumpCtime()
+}
+
+func (tf *tempFile) SetAtime(atime time.Time) {
+	tf.atime = &atime
+}
+
+func (tf *tempFile) SetCtime(ctime time.Time) {
+	tf.ctime = &ctime
+}
+
+func (tf *tempFile) SetMode() {
+	tf.bumpCtime()
+}
+
+func (tf *tempFile) SetOwner() {
+	tf.bumpCtime()
 }
 
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
-func minInt64(a int64, b int64) int64 {
-	if a < b {
-		return a
+// bumpAtime updates atime if timestampPolicy calls for it given the current
+// time.
+func (tf *tempFile) bumpAtime() {
+	now := tf.clock.Now()
+	if shouldBumpAtime(tf.timestampPolicy, now, tf.atime, tf.mtime, tf.ctime) {
+		tf.atime = &now
 	}
+}
 
-	return b
+// bumpCtime unconditionally sets ctime to the current time.
+func (tf *tempFile) bumpCtime() {
+	now := tf.clock.Now()
+	tf.ctime = &now
 }
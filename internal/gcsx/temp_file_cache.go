@@ -0,0 +1,519 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/fuse/fsutil"
+	"github.com/jacobsa/timeutil"
+)
+
+const (
+	cacheFileSuffix = ".cache"
+)
+
+// cacheKey identifies the object that a cache entry holds a copy of. Note
+// that it does not include the generation: a given (bucket, name) pair has
+// at most one index entry. A newer generation is downloaded to its own file
+// (see cacheFilename), and admitting it replaces the entry and removes the
+// older generation's file.
+type cacheKey struct {
+	Bucket string
+	Name   string
+}
+
+// cacheEntry tracks the on-disk file backing a single cacheKey.
+type cacheEntry struct {
+	path       string
+	generation int64
+	size       int64
+	atime      time.Time
+
+	// The number of live TempFiles handed out for this entry. Entries with a
+	// non-zero refCount are never evicted.
+	//
+	// cachedTempFile holds a direct pointer to the cacheEntry it was acquired
+	// against (see wrap/release below) rather than looking it up by key each
+	// time, specifically so that once a newer generation replaces this entry
+	// in c.entries, a live TempFile for this (now superseded) entry keeps
+	// decrementing *this* refCount rather than the new entry's.
+	refCount int
+}
+
+// TempFileCache manages a directory of on-disk copies of GCS object content,
+// keyed by (bucket, name, generation), so that repeated opens of the same
+// object don't re-download it. Admission is governed by a byte budget, with
+// least-recently-used entries evicted first to make room for new ones.
+//
+// Safe for concurrent access.
+type TempFileCache struct {
+	dir        string
+	byteBudget int64
+	clock      timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	entries map[cacheKey]*cacheEntry
+
+	// GUARDED_BY(mu)
+	usedBytes int64
+
+	// Per-key locks serializing Open calls that miss the cache, so that two
+	// simultaneous misses for the same key can't both fetch and download at
+	// once. Entries are never removed; the set of distinct keys touched over
+	// the life of a mount is assumed to be small relative to the cost of a
+	// mutex.
+	//
+	// GUARDED_BY(mu)
+	keyLocks map[cacheKey]*sync.Mutex
+}
+
+// NewTempFileCache creates a cache rooted at dir, which must already exist,
+// admitting at most byteBudget bytes of cached content at a time. Any cache
+// files already present in dir (from a previous process) are indexed and
+// reused rather than re-downloaded.
+func NewTempFileCache(
+	dir string,
+	byteBudget int64,
+	clock timeutil.Clock) (c *TempFileCache, err error) {
+	c = &TempFileCache{
+		dir:        dir,
+		byteBudget: byteBudget,
+		clock:      clock,
+		entries:    make(map[cacheKey]*cacheEntry),
+		keyLocks:   make(map[cacheKey]*sync.Mutex),
+	}
+
+	if err = c.rebuild(); err != nil {
+		err = fmt.Errorf("rebuild: %v", err)
+		return
+	}
+
+	return
+}
+
+// rebuild scans c.dir for cache files left behind by a previous process and
+// restores c.entries from their filename-encoded keys and generations. Any
+// private file left behind by a download or wrap call that never got to
+// finish (a ".tmp" or ".open" suffixed name) is necessarily orphaned, since
+// neither kind of file is meant to survive past the process that created it,
+// so it's removed outright rather than indexed. A ".cache" file whose name
+// can't be parsed is assumed to be the product of a crash mid-write and is
+// removed too.
+func (c *TempFileCache) rebuild() error {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("ReadDir: %v", err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+
+		idx := strings.Index(name, cacheFileSuffix)
+		if idx < 0 {
+			continue
+		}
+
+		path := filepath.Join(c.dir, name)
+
+		if rest := name[idx+len(cacheFileSuffix):]; rest != "" {
+			os.Remove(path)
+			continue
+		}
+
+		key, generation, ok := decodeCacheFilename(name[:idx])
+		if !ok {
+			os.Remove(path)
+			continue
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		atime, err := getAtime(fi)
+		if err != nil {
+			atime = fi.ModTime()
+		}
+
+		c.entries[key] = &cacheEntry{
+			path:       path,
+			generation: generation,
+			size:       fi.Size(),
+			atime:      atime,
+		}
+		c.usedBytes += fi.Size()
+	}
+
+	return nil
+}
+
+// Open returns a TempFile containing the content of the object identified by
+// (bucket, name, generation). If a cached copy of that exact generation
+// exists, it is served without calling fetch. Otherwise fetch is invoked to
+// download the content, which is then admitted to the cache (possibly
+// evicting other entries to stay within the byte budget).
+func (c *TempFileCache) Open(
+	ctx context.Context,
+	bucket string,
+	name string,
+	generation int64,
+	fetch func(ctx context.Context) (io.ReadCloser, error)) (tf TempFile, err error) {
+	key := cacheKey{Bucket: bucket, Name: name}
+
+	// Serialize misses for this key so that two concurrent Opens racing on an
+	// uncached (or stale) generation don't both fetch and download at once.
+	unlock := c.lockKey(key)
+	defer unlock()
+
+	if entry, ok := c.acquire(key, generation); ok {
+		return c.wrap(entry)
+	}
+
+	rc, err := fetch(ctx)
+	if err != nil {
+		err = fmt.Errorf("fetch: %v", err)
+		return
+	}
+	defer rc.Close()
+
+	path, size, err := c.download(key, generation, rc)
+	if err != nil {
+		err = fmt.Errorf("download: %v", err)
+		return
+	}
+
+	entry := c.admit(key, generation, path, size)
+
+	return c.wrap(entry)
+}
+
+// lockKey returns a function that releases the per-key lock for key, which
+// it blocks to acquire first.
+func (c *TempFileCache) lockKey(key cacheKey) (unlock func()) {
+	c.mu.Lock()
+	l, ok := c.keyLocks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		c.keyLocks[key] = l
+	}
+	c.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// acquire returns the cached entry for key if one exists and matches
+// generation, bumping its refcount and atime on the way out.
+func (c *TempFileCache) acquire(key cacheKey, generation int64) (entry *cacheEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[key]
+	if !exists || entry.generation != generation {
+		return nil, false
+	}
+
+	entry.refCount++
+	entry.atime = c.clock.Now()
+
+	return entry, true
+}
+
+// download writes content to a private temp file and atomically renames it
+// into this key's slot in the cache directory. Nothing touches the index.
+// The generation is folded into the slot's filename (see cacheFilename)
+// rather than recorded in a sidecar file renamed in alongside it, so a
+// single rename is all it takes to publish the pairing: there's no second
+// file a crash could leave disagreeing with the first.
+//
+// Writing through a fresh temp file rather than truncating the existing slot
+// in place is what keeps this safe in the presence of concurrent readers:
+// os.Rename only repoints the directory entry at key's slot, it doesn't
+// touch the inode the slot previously pointed to, so any TempFile that
+// already holds a hard link to the previous generation's content (see wrap)
+// keeps seeing that content, untouched, for as long as it's open.
+func (c *TempFileCache) download(
+	key cacheKey,
+	generation int64,
+	content io.Reader) (path string, size int64, err error) {
+	path = filepath.Join(c.dir, cacheFilename(key, generation))
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, atomic.AddUint64(&tempFileCacheLinkCounter, 1))
+
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		err = fmt.Errorf("OpenFile: %v", err)
+		return
+	}
+	defer f.Close()
+
+	size, err = io.Copy(f, content)
+	if err != nil {
+		os.Remove(tmpPath)
+		err = fmt.Errorf("copy: %v", err)
+		return
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		err = fmt.Errorf("rename: %v", err)
+		return
+	}
+
+	return
+}
+
+// admit adds (or replaces) the index entry for key, then evicts older
+// entries if necessary to respect the byte budget. The returned entry starts
+// with a refcount of one, standing in for the TempFile that the caller is
+// about to receive via wrap.
+//
+// If key already has an entry (a now-superseded generation), its directory
+// entry is removed here. That's safe even though the file's generation is
+// folded into its name (so, unlike the old slot-reuse scheme, this path
+// won't be overwritten by the new generation's rename): any TempFile still
+// open against it already holds its own hard link (see wrap), and the inode
+// isn't freed until the last such link is removed on Destroy.
+func (c *TempFileCache) admit(key cacheKey, generation int64, path string, size int64) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		c.usedBytes -= old.size
+		os.Remove(old.path)
+	}
+
+	entry := &cacheEntry{
+		path:       path,
+		generation: generation,
+		size:       size,
+		atime:      c.clock.Now(),
+		refCount:   1,
+	}
+	c.entries[key] = entry
+	c.usedBytes += size
+
+	c.evictLocked()
+
+	return entry
+}
+
+// evictLocked removes least-recently-used, unreferenced entries until
+// c.usedBytes is within c.byteBudget or no more can be evicted.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *TempFileCache) evictLocked() {
+	for c.usedBytes > c.byteBudget {
+		var oldestKey cacheKey
+		var oldest *cacheEntry
+
+		for k, e := range c.entries {
+			if e.refCount > 0 {
+				continue
+			}
+
+			if oldest == nil || e.atime.Before(oldest.atime) {
+				oldestKey, oldest = k, e
+			}
+		}
+
+		if oldest == nil {
+			// Everything remaining is still in use; we can't do better.
+			return
+		}
+
+		os.Remove(oldest.path)
+		delete(c.entries, oldestKey)
+		c.usedBytes -= oldest.size
+	}
+}
+
+// release drops one reference to entry, making it eligible for eviction
+// again once nothing else refers to it. entry is addressed directly, not
+// looked up by key, since by the time a TempFile is destroyed its entry may
+// already have been superseded (and so no longer be the one c.entries[key]
+// points at).
+func (c *TempFileCache) release(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.refCount--
+}
+
+// wrap hard-links entry's cache file into a private directory entry and
+// opens it, returning a TempFile whose Destroy releases entry instead of
+// deleting its content.
+func (c *TempFileCache) wrap(entry *cacheEntry) (tf TempFile, err error) {
+	linkPath := fmt.Sprintf("%s.%d.open", entry.path, atomic.AddUint64(&tempFileCacheLinkCounter, 1))
+
+	if err = os.Link(entry.path, linkPath); err != nil {
+		err = fmt.Errorf("Link: %v", err)
+		return
+	}
+
+	f, err := os.OpenFile(linkPath, os.O_RDWR, 0600)
+	if err != nil {
+		os.Remove(linkPath)
+		err = fmt.Errorf("OpenFile: %v", err)
+		return
+	}
+
+	tf = &cachedTempFile{
+		tempFile: &tempFile{clock: c.clock, f: f},
+		cache:    c,
+		entry:    entry,
+		linkPath: linkPath,
+		dir:      c.dir,
+	}
+
+	return
+}
+
+// tempFileCacheLinkCounter hands out distinct suffixes for the private hard
+// links created by wrap and the private temp files created by download, so
+// concurrent opens and downloads never collide on a path.
+var tempFileCacheLinkCounter uint64
+
+// cachedTempFile wraps a tempFile whose backing file started out as a hard
+// link into a TempFileCache entry. The shared content is copy-on-write: the
+// first call that would modify it breaks the link by copying the data into
+// a private anonymous file first, so concurrent openers of the same cached
+// generation never observe each other's edits.
+type cachedTempFile struct {
+	*tempFile
+
+	cache    *TempFileCache
+	entry    *cacheEntry
+	linkPath string
+	dir      string
+
+	// Whether breakLink has already run.
+	broken bool
+}
+
+// breakLink copies the still-shared backing file into a private anonymous
+// file the first time it's called, and is a no-op thereafter.
+func (ctf *cachedTempFile) breakLink() error {
+	if ctf.broken {
+		return nil
+	}
+
+	private, err := fsutil.AnonymousFile(ctf.dir)
+	if err != nil {
+		return fmt.Errorf("AnonymousFile: %v", err)
+	}
+
+	if _, err := ctf.tempFile.f.Seek(0, 0); err != nil {
+		return fmt.Errorf("Seek: %v", err)
+	}
+
+	if _, err := io.Copy(private, ctf.tempFile.f); err != nil {
+		return fmt.Errorf("copy: %v", err)
+	}
+
+	shared := ctf.tempFile.f
+	ctf.tempFile.f = private
+	shared.Close()
+	ctf.broken = true
+
+	return nil
+}
+
+func (ctf *cachedTempFile) WriteAt(p []byte, offset int64) (int, error) {
+	if err := ctf.breakLink(); err != nil {
+		return 0, err
+	}
+
+	return ctf.tempFile.WriteAt(p, offset)
+}
+
+func (ctf *cachedTempFile) Truncate(n int64) error {
+	if err := ctf.breakLink(); err != nil {
+		return err
+	}
+
+	return ctf.tempFile.Truncate(n)
+}
+
+func (ctf *cachedTempFile) Destroy() {
+	ctf.tempFile.Destroy()
+	os.Remove(ctf.linkPath)
+	ctf.cache.release(ctf.entry)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Key encoding
+////////////////////////////////////////////////////////////////////////
+
+// cacheFilename returns the name (not including c.dir) of the cache file
+// holding generation of key. Folding the generation into the name itself,
+// rather than recording it in a sidecar file written alongside the content,
+// means the name alone is always authoritative: there's no second file a
+// crash could leave out of sync with it.
+func cacheFilename(key cacheKey, generation int64) string {
+	return fmt.Sprintf("%s.%d%s", encodeCacheKey(key), generation, cacheFileSuffix)
+}
+
+// decodeCacheFilename is the inverse of cacheFilename, given the portion of
+// a cache file's name before cacheFileSuffix.
+func decodeCacheFilename(head string) (key cacheKey, generation int64, ok bool) {
+	i := strings.LastIndex(head, ".")
+	if i < 0 {
+		return cacheKey{}, 0, false
+	}
+
+	generation, err := strconv.ParseInt(head[i+1:], 10, 64)
+	if err != nil {
+		return cacheKey{}, 0, false
+	}
+
+	key, ok = decodeCacheKey(head[:i])
+	return key, generation, ok
+}
+
+// encodeCacheKey produces a filesystem-safe, round-trippable encoding of key
+// suitable for use as (part of) a cache file's name.
+func encodeCacheKey(key cacheKey) string {
+	raw := key.Bucket + "\x00" + key.Name
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCacheKey is the inverse of encodeCacheKey.
+func decodeCacheKey(encoded string) (cacheKey, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cacheKey{}, false
+	}
+
+	parts := strings.SplitN(string(raw), "\x00", 2)
+	if len(parts) != 2 {
+		return cacheKey{}, false
+	}
+
+	return cacheKey{Bucket: parts[0], Name: parts[1]}, true
+}
@@ -0,0 +1,258 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jacobsa/timeutil"
+)
+
+func readerFetch(content string) func(ctx context.Context) (io.ReadCloser, error) {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content)), nil
+	}
+}
+
+func readAll(t *testing.T, tf TempFile) string {
+	t.Helper()
+
+	sr, err := tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, sr.Size)
+	if _, err := tf.ReadAt(buf, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	return string(buf)
+}
+
+// A TempFile still open against an older generation must keep seeing that
+// generation's content, untouched, even after a newer generation has been
+// fetched and admitted for the same (bucket, name).
+func TestTempFileCacheOldGenerationSurvivesNewAdmission(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := NewTempFileCache(dir, 1<<20, timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gen1, err := c.Open(context.Background(), "bucket", "obj", 1, readerFetch("GENERATION-1-DATA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gen1.Destroy()
+
+	gen2, err := c.Open(context.Background(), "bucket", "obj", 2, readerFetch("GENERATION-2-DATA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gen2.Destroy()
+
+	if got := readAll(t, gen1); got != "GENERATION-1-DATA" {
+		t.Errorf("gen1 reads %q after gen2 was admitted, want original content", got)
+	}
+	if got := readAll(t, gen2); got != "GENERATION-2-DATA" {
+		t.Errorf("gen2 reads %q, want its own content", got)
+	}
+}
+
+// Re-opening the same (bucket, name, generation) should hit the cache rather
+// than calling fetch again.
+func TestTempFileCacheHitAvoidsFetch(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := NewTempFileCache(dir, 1<<20, timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf1, err := c.Open(context.Background(), "bucket", "obj", 1, readerFetch("DATA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf1.Destroy()
+
+	fetchCalled := false
+	tf2, err := c.Open(context.Background(), "bucket", "obj", 1, func(ctx context.Context) (io.ReadCloser, error) {
+		fetchCalled = true
+		return io.NopCloser(strings.NewReader("SHOULD-NOT-BE-USED")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf2.Destroy()
+
+	if fetchCalled {
+		t.Error("fetch was called on a cache hit")
+	}
+	if got := readAll(t, tf2); got != "DATA" {
+		t.Errorf("tf2 reads %q, want %q", got, "DATA")
+	}
+}
+
+// Concurrent misses for the same key must not race onto the same download.
+func TestTempFileCacheConcurrentMissesAreSerialized(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := NewTempFileCache(dir, 1<<20, timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	var fetchCount int64
+	fetch := func(ctx context.Context) (io.ReadCloser, error) {
+		atomic.AddInt64(&fetchCount, 1)
+		return io.NopCloser(strings.NewReader("DATA")), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]TempFile, n)
+	errs := make([]error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = c.Open(context.Background(), "bucket", "obj", 1, fetch)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Open #%d: %v", i, err)
+		}
+		if got := readAll(t, results[i]); got != "DATA" {
+			t.Errorf("Open #%d reads %q, want %q", i, got, "DATA")
+		}
+	}
+
+	for _, tf := range results {
+		tf.Destroy()
+	}
+
+	if fetchCount != 1 {
+		t.Errorf("fetch was called %d times for concurrent opens of the same key, want 1", fetchCount)
+	}
+}
+
+// Admitting content past the byte budget must evict unreferenced entries,
+// oldest first, but never an entry that's still referenced.
+func TestTempFileCacheEvictsLeastRecentlyUsedUnreferencedEntry(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := NewTempFileCache(dir, 10, timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := c.Open(context.Background(), "bucket", "old", 1, readerFetch("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Destroy() // Unreferenced, so eligible for eviction.
+
+	stillOpen, err := c.Open(context.Background(), "bucket", "kept-open", 1, readerFetch("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stillOpen.Destroy()
+
+	// Admitting "kept-open" already pushed usage to 20 bytes, past the 10-byte
+	// budget, so "old" was evicted then since it's unreferenced. Admitting a
+	// third entry exceeds the budget again, but "kept-open" must survive
+	// since it's still in use.
+	newest, err := c.Open(context.Background(), "bucket", "newest", 1, readerFetch("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newest.Destroy()
+
+	oldPath := filepath.Join(dir, cacheFilename(cacheKey{Bucket: "bucket", Name: "old"}, 1))
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("evicted entry's file %s still exists on disk", oldPath)
+	}
+
+	if got := readAll(t, stillOpen); got != "0123456789" {
+		t.Errorf("stillOpen reads %q after eviction of an unrelated entry, want original content", got)
+	}
+}
+
+// A fresh TempFileCache pointed at a directory left behind by a previous
+// process must recover its entries from disk without re-fetching them, and
+// must clean up any private *.tmp/*.open files a crash left behind.
+func TestTempFileCacheRebuildRecoversEntriesAndSweepsOrphans(t *testing.T) {
+	dir := t.TempDir()
+
+	c1, err := NewTempFileCache(dir, 1<<20, timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := c1.Open(context.Background(), "bucket", "obj", 7, readerFetch("PERSISTED"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.Destroy()
+
+	// Simulate crash leftovers from a previous process: a partial download and
+	// a dangling hard link from wrap, neither of which rebuild should mistake
+	// for a real entry.
+	for _, name := range []string{"bogus.cache.1.tmp", "bogus.cache.2.open"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetchCalled := false
+	c2, err := NewTempFileCache(dir, 1<<20, timeutil.RealClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf2, err := c2.Open(context.Background(), "bucket", "obj", 7, func(ctx context.Context) (io.ReadCloser, error) {
+		fetchCalled = true
+		return io.NopCloser(strings.NewReader("SHOULD-NOT-BE-USED")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf2.Destroy()
+
+	if fetchCalled {
+		t.Error("fetch was called even though rebuild should have recovered the entry from disk")
+	}
+	if got := readAll(t, tf2); got != "PERSISTED" {
+		t.Errorf("tf2 reads %q, want %q", got, "PERSISTED")
+	}
+
+	for _, name := range []string{"bogus.cache.1.tmp", "bogus.cache.2.open"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("orphaned file %s survived rebuild", name)
+		}
+	}
+}
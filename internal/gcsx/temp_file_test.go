@@ -0,0 +1,214 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+func TestTempFileWriteAtMarksDirty(t *testing.T) {
+	tf, err := NewTempFile(strings.NewReader("0123456789"), "", timeutil.RealClock(), Strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	if _, err := tf.WriteAt([]byte("XY"), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Range{{Start: 2, End: 4}}
+	if len(sr.DirtyRanges) != 1 || sr.DirtyRanges[0] != want[0] {
+		t.Errorf("DirtyRanges = %v, want %v", sr.DirtyRanges, want)
+	}
+	if sr.DirtyThreshold != 2 {
+		t.Errorf("DirtyThreshold = %d, want 2", sr.DirtyThreshold)
+	}
+}
+
+func TestTempFileTruncateGrowMarksTailDirty(t *testing.T) {
+	tf, err := NewTempFile(strings.NewReader("0123456789"), "", timeutil.RealClock(), Strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	if err := tf.Truncate(20); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The grown tail [10, 20) never existed in the original content, so an
+	// uploader relying on DirtyRanges to decide what to re-transmit must see
+	// it as dirty.
+	if sr.DirtyThreshold != 10 {
+		t.Errorf("DirtyThreshold = %d, want 10 (grown tail not marked dirty)", sr.DirtyThreshold)
+	}
+
+	want := []Range{{Start: 10, End: 20}}
+	if len(sr.DirtyRanges) != 1 || sr.DirtyRanges[0] != want[0] {
+		t.Errorf("DirtyRanges = %v, want %v", sr.DirtyRanges, want)
+	}
+}
+
+func TestTempFileTruncateShrinkDropsDirtyRanges(t *testing.T) {
+	tf, err := NewTempFile(strings.NewReader("0123456789"), "", timeutil.RealClock(), Strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	if _, err := tf.WriteAt([]byte("X"), 8); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tf.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sr.Size != 5 || sr.DirtyThreshold != 5 || len(sr.DirtyRanges) != 0 {
+		t.Errorf("Stat() = %+v, want Size=5 DirtyThreshold=5 DirtyRanges=[]", sr)
+	}
+}
+
+func TestShouldBumpAtime(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	hourAgo := epoch.Add(-time.Hour)
+	dayAndAHourAgo := epoch.Add(-25 * time.Hour)
+
+	cases := []struct {
+		name   string
+		policy TimestampPolicy
+		atime  *time.Time
+		mtime  *time.Time
+		ctime  *time.Time
+		want   bool
+	}{
+		{name: "strict always bumps", policy: Strict, atime: &hourAgo, want: true},
+
+		{name: "noatime never bumps, even with no prior atime", policy: Noatime, atime: nil, want: false},
+		{name: "noatime never bumps", policy: Noatime, atime: &hourAgo, want: false},
+
+		{name: "relatime bumps when atime was never set", policy: Relatime, atime: nil, want: true},
+		{name: "relatime doesn't bump a recent atime with no newer mtime/ctime",
+			policy: Relatime, atime: &hourAgo, want: false},
+		{name: "relatime bumps once atime is more than a day old",
+			policy: Relatime, atime: &dayAndAHourAgo, want: true},
+		{name: "relatime bumps when atime predates mtime",
+			policy: Relatime, atime: &hourAgo, mtime: &epoch, want: true},
+		{name: "relatime bumps when atime predates ctime",
+			policy: Relatime, atime: &hourAgo, ctime: &epoch, want: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := shouldBumpAtime(c.policy, epoch, c.atime, c.mtime, c.ctime)
+			if got != c.want {
+				t.Errorf("shouldBumpAtime(%v, ...) = %v, want %v", c.policy, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTempFileNoatimeNeverBumpsAtime(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Unix(1000, 0))
+
+	tf, err := NewTempFile(strings.NewReader("0123456789"), "", clock, Noatime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	buf := make([]byte, 4)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Atime != nil {
+		t.Errorf("Atime = %v, want nil under Noatime", sr.Atime)
+	}
+}
+
+func TestTempFileRelatimeSkipsRedundantBumps(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Unix(1000, 0))
+
+	tf, err := NewTempFile(strings.NewReader("0123456789"), "", clock, Relatime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Destroy()
+
+	buf := make([]byte, 4)
+
+	// The first read always bumps atime, since there is none yet.
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := *sr.Atime
+
+	// A read moments later shouldn't move atime again.
+	clock.AdvanceTime(time.Minute)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	sr, err = tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sr.Atime.Equal(first) {
+		t.Errorf("Atime moved from %v to %v on a read moments later", first, sr.Atime)
+	}
+
+	// But a read more than a day later should.
+	clock.AdvanceTime(25 * time.Hour)
+	if _, err := tf.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	sr, err = tf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Atime.Equal(first) {
+		t.Errorf("Atime didn't move on a read more than a day later")
+	}
+}